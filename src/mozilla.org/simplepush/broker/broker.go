@@ -0,0 +1,38 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package broker fans updates out to whichever node in the fleet actually
+// holds the client's websocket. A REST UpdateHandler call only ever reaches
+// sockets connected to the local process; when the client landed on a
+// different node, the update used to sit in storage until that node's next
+// poll. Broker publishes the version bump to every node so the owning one
+// can flush immediately.
+package broker
+
+// Update is the payload published on a channel whenever storage records a
+// new version for a UAID/channelID pair.
+type Update struct {
+	Uaid    string
+	Chid    string
+	Version int64
+}
+
+// Broker is the pluggable pubsub backend a node subscribes to at boot and
+// publishes to whenever UpdateHandler persists a version bump. Messages are
+// addressed by UAID (channel name "push.<uaid>") so a node only registers
+// handlers for the UAIDs it actually owns a socket for. Whether the backend
+// connection itself receives every update in the fleet depends on the
+// implementation: RedisBroker pattern-subscribes to "push.*" and filters
+// locally, PostgresBroker LISTENs per UAID channel.
+type Broker interface {
+	// Publish announces a version bump for uaid/chid to every subscriber,
+	// including other nodes (and, if Subscribe was called for this uaid,
+	// this one).
+	Publish(update Update) error
+	// Subscribe registers handler to be called with every Update
+	// published for uaid. Returns a function that unsubscribes.
+	Subscribe(uaid string, handler func(Update)) (unsubscribe func(), err error)
+	// Close shuts down the underlying connection(s).
+	Close() error
+}
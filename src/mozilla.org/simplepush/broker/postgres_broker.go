@@ -0,0 +1,110 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broker
+
+import (
+	"github.com/lib/pq"
+
+	"database/sql"
+	"encoding/json"
+	"sync"
+)
+
+// PostgresBroker publishes version bumps via LISTEN/NOTIFY, for operators
+// who already run Postgres for storage and would rather not run a second
+// pubsub service just for fan-out.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+
+	mu       sync.Mutex
+	handlers map[string][]func(Update)
+}
+
+// NewPostgresBroker opens db (used for NOTIFY) and a dedicated
+// pq.Listener (used for LISTEN) against the same connection string.
+func NewPostgresBroker(conninfo string) (*PostgresBroker, error) {
+	db, err := sql.Open("postgres", conninfo)
+	if err != nil {
+		return nil, err
+	}
+	listener := pq.NewListener(conninfo, 0, 0, nil)
+	b := &PostgresBroker{db: db, listener: listener, handlers: make(map[string][]func(Update))}
+	go b.listen()
+	return b, nil
+}
+
+func (b *PostgresBroker) Publish(update Update) error {
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", channelFor(update.Uaid), string(raw))
+	return err
+}
+
+func (b *PostgresBroker) Subscribe(uaid string, handler func(Update)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	channel := channelFor(uaid)
+	if len(b.handlers[uaid]) == 0 {
+		if err := b.listener.Listen(channel); err != nil {
+			return nil, err
+		}
+	}
+	b.handlers[uaid] = append(b.handlers[uaid], handler)
+	index := len(b.handlers[uaid]) - 1
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.removeHandler(uaid, index)
+	}, nil
+}
+
+// removeHandler must be called with b.mu held. It clears the handler slot
+// and, once every slot for uaid is empty, drops the map entry and the
+// channel's LISTEN so a connect/disconnect cycle doesn't leak a live
+// subscription for every UAID that's ever connected.
+func (b *PostgresBroker) removeHandler(uaid string, index int) {
+	handlers, ok := b.handlers[uaid]
+	if !ok || index >= len(handlers) {
+		return
+	}
+	handlers[index] = nil
+	for _, h := range handlers {
+		if h != nil {
+			return
+		}
+	}
+	delete(b.handlers, uaid)
+	b.listener.Unlisten(channelFor(uaid))
+}
+
+func (b *PostgresBroker) listen() {
+	for n := range b.listener.Notify {
+		if n == nil {
+			continue
+		}
+		var update Update
+		if err := json.Unmarshal([]byte(n.Extra), &update); err != nil {
+			continue
+		}
+		b.mu.Lock()
+		handlers := append([]func(Update){}, b.handlers[update.Uaid]...)
+		b.mu.Unlock()
+		for _, h := range handlers {
+			if h != nil {
+				h(update)
+			}
+		}
+	}
+}
+
+func (b *PostgresBroker) Close() error {
+	b.listener.Close()
+	return b.db.Close()
+}
@@ -0,0 +1,153 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package broker
+
+import (
+	"github.com/garyburd/redigo/redis"
+
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const patternChannel = "push.*"
+
+// RedisBroker publishes version bumps over Redis pub/sub. PUBLISH uses the
+// pool; every Subscribe shares a single PSUBSCRIBE("push.*") connection and
+// is dispatched to by parsed channel name, rather than opening one
+// dedicated connection (and listener goroutine) per UAID, which wouldn't
+// scale to the connection counts max_connections is meant to admit.
+type RedisBroker struct {
+	pool *redis.Pool
+
+	mu       sync.Mutex
+	conn     *redis.PubSubConn
+	handlers map[string][]func(Update)
+}
+
+// NewRedisBroker dials addr (host:port) lazily via a redis.Pool. The shared
+// pattern subscription is opened on the first Subscribe call.
+func NewRedisBroker(addr string) *RedisBroker {
+	return &RedisBroker{
+		pool: &redis.Pool{
+			MaxIdle: 3,
+			Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		},
+		handlers: make(map[string][]func(Update)),
+	}
+}
+
+func channelFor(uaid string) string {
+	return fmt.Sprintf("push.%s", uaid)
+}
+
+func uaidFromChannel(channel string) (string, bool) {
+	uaid := strings.TrimPrefix(channel, "push.")
+	return uaid, uaid != channel
+}
+
+func (b *RedisBroker) Publish(update Update) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PUBLISH", channelFor(update.Uaid), raw)
+	return err
+}
+
+// Subscribe registers handler for uaid against the shared pattern
+// connection, opening it on the very first call.
+func (b *RedisBroker) Subscribe(uaid string, handler func(Update)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		conn := &redis.PubSubConn{Conn: b.pool.Get()}
+		if err := conn.PSubscribe(patternChannel); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		b.conn = conn
+		go b.listen(conn)
+	}
+	b.handlers[uaid] = append(b.handlers[uaid], handler)
+	index := len(b.handlers[uaid]) - 1
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.removeHandler(uaid, index)
+	}, nil
+}
+
+// removeHandler must be called with b.mu held. It clears the handler slot
+// and, once every slot for uaid is empty, drops the map entry entirely so
+// a connect/disconnect cycle doesn't leak an ever-growing handlers map.
+func (b *RedisBroker) removeHandler(uaid string, index int) {
+	handlers, ok := b.handlers[uaid]
+	if !ok || index >= len(handlers) {
+		return
+	}
+	handlers[index] = nil
+	for _, h := range handlers {
+		if h != nil {
+			return
+		}
+	}
+	delete(b.handlers, uaid)
+}
+
+func (b *RedisBroker) listen(conn *redis.PubSubConn) {
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.PMessage:
+			uaid, ok := uaidFromChannel(v.Channel)
+			if !ok {
+				continue
+			}
+			var update Update
+			if err := json.Unmarshal(v.Data, &update); err != nil {
+				continue
+			}
+			b.mu.Lock()
+			handlers := append([]func(Update){}, b.handlers[uaid]...)
+			b.mu.Unlock()
+			// Each handler runs on its own goroutine: this is the single
+			// shared PSUBSCRIBE connection's listen loop, so a handler
+			// that blocks (e.g. writing to a dead/stale sock.Ccmd) must
+			// not be able to stall delivery for every other UAID sharing
+			// this connection.
+			for _, h := range handlers {
+				if h != nil {
+					go h(update)
+				}
+			}
+		case error:
+			b.mu.Lock()
+			if b.conn == conn {
+				b.conn = nil
+			}
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	conn := b.conn
+	b.conn = nil
+	b.handlers = make(map[string][]func(Update))
+	b.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	b.pool.Close()
+	return nil
+}
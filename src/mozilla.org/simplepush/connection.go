@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"mozilla.org/util"
+
+	"math/rand"
+	"sync/atomic"
+)
+
+const defaultMaxConnections = 25000
+
+// connCount is the process-wide count of live sockets, on any transport;
+// incremented at the top of Worker.Run, decremented wherever a socket
+// sends its DIE command.
+var connCount int64
+
+// tooManyConnections latches true on the first rejection so the metric
+// doesn't flap on every subsequent hello while still over the cap; it
+// resets once the node drops back under the threshold.
+var tooManyConnections int32
+
+// maxConnections reads "max_connections" from the app config, defaulting
+// to defaultMaxConnections.
+func maxConnections(config util.JsMap) int64 {
+	if n, ok := config["max_connections"].(int64); ok && n > 0 {
+		return n
+	}
+	return defaultMaxConnections
+}
+
+// CurrentConnections returns the live socket count, for the /status
+// endpoint.
+func CurrentConnections() int64 {
+	return atomic.LoadInt64(&connCount)
+}
+
+func incrConn() int64 {
+	return atomic.AddInt64(&connCount, 1)
+}
+
+func decrConn() {
+	atomic.AddInt64(&connCount, -1)
+}
+
+// overCapacity reports whether the node is above max, latching the
+// too_many_connections metric (TooManyConnections) on while it's true and
+// clearing it once the node drops back under the threshold.
+func overCapacity(max int64) (over bool) {
+	over = CurrentConnections() > max
+	if over {
+		atomic.StoreInt32(&tooManyConnections, 1)
+	} else {
+		atomic.StoreInt32(&tooManyConnections, 0)
+	}
+	return over
+}
+
+// TooManyConnections reports the current too_many_connections metric: true
+// from the moment a hello/upgrade is rejected for being over
+// max_connections until the node is back under the threshold. Surfaced on
+// /status so operators/alerts can see it even between log lines.
+func TooManyConnections() bool {
+	return atomic.LoadInt32(&tooManyConnections) == 1
+}
+
+// retryAfter returns a jittered backoff, in seconds, for a 503 response so
+// a fleet of rejected clients doesn't reconnect in lockstep.
+func retryAfter() int {
+	const base = 10
+	return base + rand.Intn(base)
+}
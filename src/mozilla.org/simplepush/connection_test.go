@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// resetConns zeroes the package-level connection counters so tests don't
+// leak state into each other.
+func resetConns() {
+	atomic.StoreInt64(&connCount, 0)
+	atomic.StoreInt32(&tooManyConnections, 0)
+}
+
+func TestOverCapacity(t *testing.T) {
+	resetConns()
+	defer resetConns()
+
+	incrConn()
+	incrConn()
+	if overCapacity(2) {
+		t.Error("expected not over capacity at the limit")
+	}
+	if TooManyConnections() {
+		t.Error("expected tooManyConnections to stay false at the limit")
+	}
+
+	incrConn()
+	if !overCapacity(2) {
+		t.Error("expected over capacity above the limit")
+	}
+	if !TooManyConnections() {
+		t.Error("expected tooManyConnections to latch true once over the limit")
+	}
+
+	decrConn()
+	if overCapacity(2) {
+		t.Error("expected not over capacity once back at the limit")
+	}
+	if TooManyConnections() {
+		t.Error("expected tooManyConnections to clear once back at the limit")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if ra := retryAfter(); ra < 10 || ra >= 20 {
+			t.Fatalf("retryAfter() = %d, want in [10, 20)", ra)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/igm/sockjs-go/sockjs"
+	"mozilla.org/simplepush/broker"
+	"mozilla.org/simplepush/sperrors"
+	"mozilla.org/util"
+
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UpdateHandler accepts the REST update call that third party servers use
+// to notify a UAID that new data is available. The trailing path segment
+// is either a raw "{uaid}/{channelID}" pair (token_key disabled) or an
+// opaque token minted by Worker.Register (token_key enabled); either way
+// it's resolved to a UAID/channelID pair before being handed to storage.
+func (self *Serv) UpdateHandler(resp http.ResponseWriter, req *http.Request, tokens *TokenKeyManager) {
+	path := strings.TrimPrefix(req.URL.Path, "/update/")
+	uaid, chid, err := resolveEndpointPath(tokens, path)
+	if err != nil {
+		self.log.Error("handler", "Invalid update path", util.JsMap{"path": path, "error": err})
+		http.Error(resp, "Not Found", http.StatusNotFound)
+		return
+	}
+	version, _ := strconv.ParseInt(req.FormValue("version"), 10, 64)
+	if err := self.Store.UpdateChannel(uaid, chid, version); err != nil {
+		self.log.Error("handler", "Could not update channel",
+			util.JsMap{"uaid": uaid, "chid": chid, "error": err})
+		http.Error(resp, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	// If the owning socket is connected to this node, flush it directly;
+	// otherwise fan out through the Broker so whichever node does hold it
+	// can flush without waiting for its next storage poll. The Locator
+	// (the same "which node owns this UAID" hint Worker.Hello uses to
+	// redirect) lets us tell a stale-registry miss (we own it, but the
+	// socket's gone) from a genuine remote delivery, and gives the
+	// publish-path logging a concrete target instead of firing blind.
+	if sock, ok := registry.Lookup(uaid); ok {
+		incrLocalHit()
+		sock.Ccmd <- PushCommand{Command: FLUSH, Arguments: util.JsMap{
+			"uaid": uaid, "chid": chid, "version": version}}
+	} else if activeBroker != nil {
+		skip := false
+		if activeLocator != nil {
+			if host, mine, lerr := activeLocator.Owner(uaid); lerr == nil && mine {
+				// We're the owner of record but have no local registry
+				// entry: the socket died without its DIE making it
+				// through. No other node can own this UAID, so publishing
+				// would reach no one; skip the round-trip rather than pay
+				// it for nothing.
+				self.log.Info("handler", "No local socket for owned uaid, skipping publish",
+					util.JsMap{"uaid": uaid, "host": host})
+				skip = true
+			} else if lerr == nil {
+				self.log.Debug("handler", "Publishing update for remote owner",
+					util.JsMap{"uaid": uaid, "host": host})
+			}
+		}
+		if !skip {
+			incrRemoteDelivered()
+			if err := activeBroker.Publish(broker.Update{Uaid: uaid, Chid: chid, Version: version}); err != nil {
+				self.log.Error("handler", "Could not publish update",
+					util.JsMap{"uaid": uaid, "chid": chid, "error": err})
+			}
+		}
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// PushSocketHandler upgrades the connection to a raw websocket and runs it
+// through the same Worker.Run loop as every other transport. Registered at
+// "/ws" so it lives alongside the SockJS prefix below. If the node is
+// already at max_connections, the upgrade itself is refused with a plain
+// 503 rather than spent on a socket that Hello would just reject anyway.
+func (self *Serv) PushSocketHandler(config util.JsMap) http.Handler {
+	max := maxConnections(config)
+	upgrade := websocket.Handler(func(ws *websocket.Conn) {
+		sock := PushWS{Transport: NewWebsocketTransport(ws), Store: self.Store, Logger: self.log}
+		NewWorker(config).Run(sock)
+	})
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if overCapacity(max) {
+			http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		upgrade.ServeHTTP(resp, req)
+	})
+}
+
+// StatusHandler gives a load balancer a real readiness signal: the current
+// connection count against max_connections, plus a storage round-trip
+// (set/get/delete of a random key) so a wedged storage backend takes the
+// node out of rotation even if its sockets are otherwise healthy.
+func (self *Serv) StatusHandler(resp http.ResponseWriter, req *http.Request, config util.JsMap) {
+	localHits, remoteDelivered := FanoutCounts()
+	status := util.JsMap{
+		"connections":        CurrentConnections(),
+		"maxConnections":     maxConnections(config),
+		"tooManyConnections": TooManyConnections(),
+		"localHits":          localHits,
+		"remoteDelivered":    remoteDelivered,
+	}
+	if err := self.pingStorage(); err != nil {
+		status["storage"] = "error"
+		status["storageError"] = err.Error()
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		status["storage"] = "ok"
+	}
+	raw, _ := json.Marshal(status)
+	resp.Write(raw)
+}
+
+// pingStorage exercises a full set/get/delete round-trip against a
+// throwaway key, rather than just checking the connection is open, so a
+// backend that accepts connections but can't actually serve reads (e.g. a
+// full disk) still fails the check.
+func (self *Serv) pingStorage() error {
+	key, err := GenUUID4()
+	if err != nil {
+		return err
+	}
+	if err := self.Store.RegisterAppID(key, "status-ping", 0); err != nil {
+		return err
+	}
+	if _, err := self.Store.GetUpdates(key, 0); err != nil {
+		self.Store.DeleteAppID(key, "status-ping", false)
+		return err
+	}
+	return self.Store.DeleteAppID(key, "status-ping", false)
+}
+
+// SockJSHandler exposes the same push protocol over SockJS's
+// XHR-streaming, XHR-polling, EventSource, and websocket sub-transports,
+// for clients behind proxies that strip the Upgrade header. Registered at
+// "/sockjs" so it doesn't collide with the raw websocket prefix. As with
+// PushSocketHandler, a node already at max_connections refuses the upgrade
+// with a plain 503 instead of spinning up a session Hello would just reject.
+func (self *Serv) SockJSHandler(config util.JsMap) http.Handler {
+	max := maxConnections(config)
+	tc := NewTransportConfig(config)
+	opts := sockjs.DefaultOptions
+	opts.HeartbeatDelay = tc.HeartbeatInterval
+	// sockjs-go only exposes a single independent toggle for its
+	// sub-transports: Websocket. The XHR-streaming/XHR-polling/
+	// EventSource fallbacks are always served (that's the point of
+	// SockJS), so "allowed_transports" can only gate websocket itself.
+	opts.Websocket = tc.Allows("websocket")
+	handler := sockjs.NewHandler("/sockjs", opts, func(session sockjs.Session) {
+		sock := PushWS{
+			Transport: NewSockJSTransport(session, tc.HeartbeatInterval),
+			Store:     self.Store,
+			Logger:    self.log,
+		}
+		NewWorker(config).Run(sock)
+	})
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if overCapacity(max) {
+			http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// resolveEndpointPath turns the trailing segment of a pushEndpoint URL back
+// into a UAID/channelID pair, decrypting it first if token_key is enabled.
+func resolveEndpointPath(tokens *TokenKeyManager, path string) (uaid, chid string, err error) {
+	if tokens.Enabled() {
+		return tokens.Decrypt(path)
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", sperrors.InvalidDataError
+	}
+	return parts[0], parts[1], nil
+}
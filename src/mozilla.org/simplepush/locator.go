@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"mozilla.org/util"
+
+	"hash/fnv"
+	"sort"
+)
+
+// Locator answers "which node in the fleet owns this UAID", so a HELLO
+// landing on the wrong node can redirect the client instead of silently
+// handling it locally. Implementations are expected to agree on the same
+// answer for a given UAID without talking to each other, e.g. by hashing
+// over a shared, statically configured contact list.
+type Locator interface {
+	// Owner returns the contact that owns uaid. mine is true when that
+	// contact is this node (MemberSelf), so callers can skip the
+	// redirect.
+	Owner(uaid string) (host string, mine bool, err error)
+	// MemberSelf is this node's own entry in the contact list, used to
+	// break ties between Owner's answer and the local host.
+	MemberSelf() string
+	Close() error
+}
+
+// StaticLocator shards UAIDs across a fixed, operator-supplied list of
+// contacts using rendezvous (highest random weight) hashing: every node
+// computes the same winner for a given UAID independently, so no shared
+// session store or coordination round-trip is needed, and the set of
+// UAIDs that move is minimal when a contact is added or removed.
+type StaticLocator struct {
+	log      *util.HekaLogger
+	self     string
+	contacts []string
+}
+
+// NewStaticLocator builds a Locator from the app config. "contacts" is the
+// full list of node hostnames in the fleet (this node's own host must be
+// included); "self" identifies which entry in that list is us.
+func NewStaticLocator(config util.JsMap, log *util.HekaLogger) *StaticLocator {
+	l := &StaticLocator{log: log}
+	if self, ok := config["self"].(string); ok {
+		l.self = self
+	}
+	if raw, ok := config["contacts"].([]string); ok {
+		l.contacts = raw
+	} else if raw, ok := config["contacts"].([]interface{}); ok {
+		for _, c := range raw {
+			if s, ok := c.(string); ok {
+				l.contacts = append(l.contacts, s)
+			}
+		}
+	}
+	return l
+}
+
+func (l *StaticLocator) MemberSelf() string {
+	return l.self
+}
+
+func (l *StaticLocator) Close() error {
+	return nil
+}
+
+// Owner rendezvous-hashes uaid against the contact list and returns
+// whichever contact scores highest. With a single contact (or none
+// configured, which is the common single-node deployment) it always
+// resolves to this node.
+func (l *StaticLocator) Owner(uaid string) (host string, mine bool, err error) {
+	if len(l.contacts) == 0 {
+		return l.self, true, nil
+	}
+	host = rendezvousWinner(l.contacts, uaid)
+	return host, host == l.self, nil
+}
+
+// rendezvousWinner picks the contact with the highest hash(contact, key),
+// so every node sees the same winner for a given key without needing to
+// agree on anything beyond the (static) contact list itself.
+func rendezvousWinner(contacts []string, key string) string {
+	sorted := make([]string, len(contacts))
+	copy(sorted, contacts)
+	sort.Strings(sorted)
+
+	var winner string
+	var winnerWeight uint32
+	for i, contact := range sorted {
+		h := fnv.New32a()
+		h.Write([]byte(contact))
+		h.Write([]byte(key))
+		weight := h.Sum32()
+		if i == 0 || weight > winnerWeight {
+			winner = contact
+			winnerWeight = weight
+		}
+	}
+	return winner
+}
@@ -0,0 +1,31 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import "sync/atomic"
+
+// fanoutMetrics counts how updates reached a client: flushed straight from
+// this node's in-memory registry ("local") versus routed through the
+// Broker because the owning socket lives on a peer ("remote"). A healthy
+// fleet should see local hits dominate once the Locator is steering
+// clients to the right node on HELLO.
+var fanoutMetrics struct {
+	localHits       int64
+	remoteDelivered int64
+}
+
+func incrLocalHit() {
+	atomic.AddInt64(&fanoutMetrics.localHits, 1)
+}
+
+func incrRemoteDelivered() {
+	atomic.AddInt64(&fanoutMetrics.remoteDelivered, 1)
+}
+
+// FanoutCounts returns a snapshot of the local-hit / remote-delivered
+// counters, for the /status endpoint and friends.
+func FanoutCounts() (localHits, remoteDelivered int64) {
+	return atomic.LoadInt64(&fanoutMetrics.localHits), atomic.LoadInt64(&fanoutMetrics.remoteDelivered)
+}
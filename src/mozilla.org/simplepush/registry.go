@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"mozilla.org/simplepush/broker"
+	"mozilla.org/util"
+
+	"sync"
+	"time"
+)
+
+// socketEntry is one node's record of a connected UAID: the socket to
+// flush, and when it was last confirmed alive. lastSeen is refreshed on
+// Hello, on every Ping (the client's heartbeat), and on a local
+// UpdateHandler hit; reap uses it to evict connections that died without a
+// DIE making it through, e.g. a killed process, without reaping a socket
+// that's quiet but still pinging. An entry with no Hello, Ping or local hit
+// within ttl is evicted.
+type socketEntry struct {
+	sock        PushWS
+	unsubscribe func()
+	lastSeen    time.Time
+}
+
+// socketRegistry is this node's uaid -> PushWS map: which locally
+// connected sockets it can flush directly, versus having to wait on
+// storage polling. Populated on Hello, torn down on DIE.
+type socketRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*socketEntry
+	ttl     time.Duration
+}
+
+func newSocketRegistry(ttl time.Duration) *socketRegistry {
+	r := &socketRegistry{entries: make(map[string]*socketEntry), ttl: ttl}
+	go r.reap()
+	return r
+}
+
+// registry and activeBroker are process-wide: every Worker on this node
+// shares the same view of "who's connected here" and the same pubsub
+// connection, regardless of which goroutine is handling a given socket.
+var registry = newSocketRegistry(5 * time.Minute)
+var activeBroker broker.Broker
+
+// activeLocator is the process-wide Locator, set up by InitLocator so
+// UpdateHandler can consult the same "which node owns this UAID" answer
+// every Worker's Hello already uses for its redirect check. A nil
+// activeLocator (InitLocator never called, e.g. single-node deployments
+// that don't bother) just means UpdateHandler always falls through to
+// Broker.Publish, same as before this existed.
+var activeLocator Locator
+
+// InitLocator wires up the shared Locator from the app config. Called once
+// at startup, same as InitBroker.
+func InitLocator(config util.JsMap, log *util.HekaLogger) {
+	activeLocator = NewStaticLocator(config, log)
+}
+
+// InitBroker wires up the cross-node fan-out backend from the app config.
+// "broker_type" selects "redis" or "postgres"; the corresponding
+// "broker_redis_addr" or "broker_postgres_dsn" supplies the connection
+// info. Called once at startup; a nil activeBroker (the default) simply
+// means updates for UAIDs on other nodes wait for storage polling, same as
+// before this existed.
+func InitBroker(config util.JsMap) (err error) {
+	switch config["broker_type"] {
+	case "redis":
+		addr, _ := config["broker_redis_addr"].(string)
+		activeBroker = broker.NewRedisBroker(addr)
+	case "postgres":
+		dsn, _ := config["broker_postgres_dsn"].(string)
+		activeBroker, err = broker.NewPostgresBroker(dsn)
+	}
+	return err
+}
+
+// Register records sock as the local holder of uaid, and subscribes it to
+// the Broker so cross-node updates for uaid land directly on its Ccmd
+// channel instead of waiting for the next storage poll. A uaid re-Helloing
+// on the same connection (Worker.Hello allows repeating its own uaid) or
+// reconnecting before the old entry is reaped would otherwise leak the
+// previous Broker subscription, so any existing entry's unsubscribe is
+// called once the new one is installed.
+func (r *socketRegistry) Register(b broker.Broker, uaid string, sock PushWS) {
+	var unsubscribe func()
+	if b != nil {
+		unsubscribe, _ = b.Subscribe(uaid, func(update broker.Update) {
+			sock.Ccmd <- PushCommand{Command: FLUSH, Arguments: util.JsMap{
+				"uaid":    update.Uaid,
+				"chid":    update.Chid,
+				"version": update.Version}}
+		})
+	}
+	r.mu.Lock()
+	prev, hadPrev := r.entries[uaid]
+	r.entries[uaid] = &socketEntry{sock: sock, unsubscribe: unsubscribe, lastSeen: time.Now()}
+	r.mu.Unlock()
+	if hadPrev && prev.unsubscribe != nil {
+		prev.unsubscribe()
+	}
+}
+
+// Unregister tears down the registration made on Hello; called on DIE.
+func (r *socketRegistry) Unregister(uaid string) {
+	r.mu.Lock()
+	entry, ok := r.entries[uaid]
+	delete(r.entries, uaid)
+	r.mu.Unlock()
+	if ok && entry.unsubscribe != nil {
+		entry.unsubscribe()
+	}
+}
+
+// Lookup reports whether uaid has a socket on this node, so UpdateHandler
+// can short-circuit straight to Flush instead of publishing to the Broker.
+func (r *socketRegistry) Lookup(uaid string) (PushWS, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[uaid]
+	if !ok {
+		return PushWS{}, false
+	}
+	entry.lastSeen = time.Now()
+	return entry.sock, true
+}
+
+// Touch refreshes lastSeen for uaid without otherwise disturbing the
+// entry, so a quiet-but-connected client that only ever pings keeps its
+// Broker subscription alive instead of being reaped out from under it.
+func (r *socketRegistry) Touch(uaid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[uaid]; ok {
+		entry.lastSeen = time.Now()
+	}
+}
+
+// reap evicts entries that haven't been touched in ttl, so a node that
+// died without its DIE command making it through doesn't leak Broker
+// subscriptions forever.
+func (r *socketRegistry) reap() {
+	if r.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.ttl)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-r.ttl)
+		r.mu.Lock()
+		for uaid, entry := range r.entries {
+			if entry.lastSeen.Before(cutoff) {
+				delete(r.entries, uaid)
+				if entry.unsubscribe != nil {
+					entry.unsubscribe()
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+}
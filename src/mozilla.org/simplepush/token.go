@@ -0,0 +1,174 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"mozilla.org/simplepush/sperrors"
+	"mozilla.org/util"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// TokenKeyManager turns the opaque {uaid}/{channelID} tuple that would
+// otherwise appear in a pushEndpoint URL into an AES-GCM sealed token, so
+// operators who don't want raw device/channel identifiers leaking into
+// client-visible URLs can turn encryption on without changing the wire
+// protocol. Keys are keyed by a short keyID so a key rotation doesn't
+// invalidate endpoints that were minted under the previous key.
+type TokenKeyManager struct {
+	enabled bool
+	keyID   string
+	keys    map[string][]byte
+}
+
+// NewTokenKeyManager builds a manager from the app config. "token_key" is
+// the active, base64-encoded AES key (16, 24, or 32 raw bytes); "key_id" is
+// the short prefix stamped on tokens minted with it; "old_token_keys" is an
+// optional map of keyID -> base64 key kept around so endpoints minted
+// before a rotation keep decrypting. If "token_key" is empty, encryption is
+// disabled and Register falls back to the plain {uaid}/{channelID} path.
+func NewTokenKeyManager(config util.JsMap) (*TokenKeyManager, error) {
+	rawKey, _ := config["token_key"].(string)
+	if len(rawKey) == 0 {
+		return &TokenKeyManager{enabled: false}, nil
+	}
+	keyID, _ := config["key_id"].(string)
+	if len(keyID) == 0 {
+		keyID = "0"
+	}
+	m := &TokenKeyManager{
+		enabled: true,
+		keyID:   keyID,
+		keys:    make(map[string][]byte),
+	}
+	key, err := decodeKey(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	m.keys[keyID] = key
+	if old, ok := config["old_token_keys"].(util.JsMap); ok {
+		for id, v := range old {
+			raw, _ := v.(string)
+			if len(raw) == 0 {
+				continue
+			}
+			oldKey, err := decodeKey(raw)
+			if err != nil {
+				return nil, err
+			}
+			m.keys[id] = oldKey
+		}
+	}
+	return m, nil
+}
+
+func decodeKey(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, errors.New("token_key must decode to 16, 24, or 32 bytes")
+}
+
+// Enabled reports whether endpoint encryption is turned on.
+func (m *TokenKeyManager) Enabled() bool {
+	return m != nil && m.enabled
+}
+
+// Encrypt seals uaid/chid into a single URL-safe, base64-encoded token
+// prefixed with the active keyID (e.g. "0.<token>"), so Decrypt can later
+// pick the right key even after a rotation. uaid is length-prefixed in the
+// plaintext rather than joined with a delimiter, since unlike channelID
+// (filtered to [\w-] in Worker.Register) it isn't restricted to a
+// delimiter-free character set.
+func (m *TokenKeyManager) Encrypt(uaid, chid string) (string, error) {
+	gcm, err := m.gcmFor(m.keyID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	plaintext := encodePair(uaid, chid)
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return m.keyID + "." + base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt recovers the uaid/chid pair sealed into a token minted by
+// Encrypt, using whichever key (current or rotated-out) matches the
+// token's keyID prefix.
+func (m *TokenKeyManager) Decrypt(token string) (uaid, chid string, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", "", sperrors.InvalidDataError
+	}
+	gcm, err := m.gcmFor(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", sperrors.InvalidDataError
+	}
+	nonceSize := gcm.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", "", sperrors.InvalidDataError
+	}
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", "", sperrors.InvalidDataError
+	}
+	return decodePair(plaintext)
+}
+
+// encodePair lays out uaid/chid as a 4-byte big-endian length prefix
+// followed by uaid, then the remainder is chid. This avoids splitting on a
+// delimiter character that a client-supplied uaid (unlike the
+// regex-filtered channelID) isn't guaranteed to be free of.
+func encodePair(uaid, chid string) []byte {
+	buf := make([]byte, 4+len(uaid)+len(chid))
+	binary.BigEndian.PutUint32(buf, uint32(len(uaid)))
+	copy(buf[4:], uaid)
+	copy(buf[4+len(uaid):], chid)
+	return buf
+}
+
+func decodePair(plaintext []byte) (uaid, chid string, err error) {
+	if len(plaintext) < 4 {
+		return "", "", sperrors.InvalidDataError
+	}
+	uaidLen := int(binary.BigEndian.Uint32(plaintext))
+	if uaidLen < 0 || 4+uaidLen > len(plaintext) {
+		return "", "", sperrors.InvalidDataError
+	}
+	uaid = string(plaintext[4 : 4+uaidLen])
+	chid = string(plaintext[4+uaidLen:])
+	return uaid, chid, nil
+}
+
+func (m *TokenKeyManager) gcmFor(keyID string) (cipher.AEAD, error) {
+	key, ok := m.keys[keyID]
+	if !ok {
+		return nil, sperrors.InvalidDataError
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"mozilla.org/util"
+
+	"testing"
+)
+
+func TestTokenKeyManagerRoundTrip(t *testing.T) {
+	config := util.JsMap{"token_key": "MDEyMzQ1Njc4OWFiY2RlZg==", "key_id": "1"}
+	m, err := NewTokenKeyManager(config)
+	if err != nil {
+		t.Fatalf("NewTokenKeyManager: %v", err)
+	}
+	if !m.Enabled() {
+		t.Fatal("expected manager to be enabled")
+	}
+
+	token, err := m.Encrypt("some-uaid", "some-chid")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	uaid, chid, err := m.Decrypt(token)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if uaid != "some-uaid" || chid != "some-chid" {
+		t.Fatalf("got uaid=%q chid=%q, want uaid=some-uaid chid=some-chid", uaid, chid)
+	}
+}
+
+func TestTokenKeyManagerUaidWithDot(t *testing.T) {
+	// uaid is only length-checked in Worker.Hello, not character-filtered
+	// like channelID, so a "." in it must not corrupt the decrypted pair.
+	config := util.JsMap{"token_key": "MDEyMzQ1Njc4OWFiY2RlZg=="}
+	m, err := NewTokenKeyManager(config)
+	if err != nil {
+		t.Fatalf("NewTokenKeyManager: %v", err)
+	}
+
+	token, err := m.Encrypt("uaid.with.dots", "chid-1")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	uaid, chid, err := m.Decrypt(token)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if uaid != "uaid.with.dots" || chid != "chid-1" {
+		t.Fatalf("got uaid=%q chid=%q, want uaid=uaid.with.dots chid=chid-1", uaid, chid)
+	}
+}
+
+func TestTokenKeyManagerRotation(t *testing.T) {
+	// Endpoints minted under an old key must keep decrypting after the
+	// active key_id changes.
+	oldConfig := util.JsMap{"token_key": "MDEyMzQ1Njc4OWFiY2RlZg==", "key_id": "0"}
+	oldManager, err := NewTokenKeyManager(oldConfig)
+	if err != nil {
+		t.Fatalf("NewTokenKeyManager(old): %v", err)
+	}
+	token, err := oldManager.Encrypt("uaid-1", "chid-1")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	newConfig := util.JsMap{
+		"token_key": "ZmVkY2JhOTg3NjU0MzIxMA==",
+		"key_id":    "1",
+		"old_token_keys": util.JsMap{
+			"0": "MDEyMzQ1Njc4OWFiY2RlZg==",
+		},
+	}
+	newManager, err := NewTokenKeyManager(newConfig)
+	if err != nil {
+		t.Fatalf("NewTokenKeyManager(new): %v", err)
+	}
+	uaid, chid, err := newManager.Decrypt(token)
+	if err != nil {
+		t.Fatalf("Decrypt after rotation: %v", err)
+	}
+	if uaid != "uaid-1" || chid != "chid-1" {
+		t.Fatalf("got uaid=%q chid=%q, want uaid=uaid-1 chid=chid-1", uaid, chid)
+	}
+}
+
+func TestTokenKeyManagerDisabled(t *testing.T) {
+	m, err := NewTokenKeyManager(util.JsMap{})
+	if err != nil {
+		t.Fatalf("NewTokenKeyManager: %v", err)
+	}
+	if m.Enabled() {
+		t.Fatal("expected manager to be disabled without a token_key")
+	}
+}
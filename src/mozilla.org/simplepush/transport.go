@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package simplepush
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/igm/sockjs-go/sockjs"
+	"mozilla.org/util"
+
+	"encoding/json"
+	"time"
+)
+
+// Transport is everything a Worker needs from a client connection,
+// independent of whether that connection is a raw websocket or a SockJS
+// session. Worker only ever talks to a Transport, so adding a new
+// sub-protocol (or swapping one out in tests) doesn't touch worker.go.
+type Transport interface {
+	// Send marshals v as JSON and writes it to the client.
+	Send(v interface{}) error
+	// Receive blocks for the next client message and stores its raw
+	// bytes in raw; decoding is left to the caller.
+	Receive(raw *[]byte) error
+	// Close tears down the underlying connection.
+	Close() error
+	// Heartbeat returns the transport's own keep-alive interval and true
+	// if it manages heartbeats itself (e.g. SockJS's built-in "h" frames),
+	// so Ping can defer to it instead of sending a protocol-level pong.
+	Heartbeat() (interval time.Duration, managed bool)
+}
+
+// websocketTransport is the original, and default, transport: a thin
+// wrapper around code.google.com/p/go.net/websocket that satisfies
+// Transport by delegating straight to websocket.JSON (Send) and
+// websocket.Message (Receive).
+type websocketTransport struct {
+	socket *websocket.Conn
+}
+
+// NewWebsocketTransport wraps an already-upgraded websocket connection.
+func NewWebsocketTransport(socket *websocket.Conn) Transport {
+	return &websocketTransport{socket: socket}
+}
+
+func (t *websocketTransport) Send(v interface{}) error {
+	return websocket.JSON.Send(t.socket, v)
+}
+
+func (t *websocketTransport) Receive(raw *[]byte) error {
+	return websocket.Message.Receive(t.socket, raw)
+}
+
+func (t *websocketTransport) Close() error {
+	return t.socket.Close()
+}
+
+func (t *websocketTransport) Heartbeat() (time.Duration, bool) {
+	// The raw websocket handler has no frame-level heartbeat of its own;
+	// Ping falls back to the protocol-level "ping" reply.
+	return 0, false
+}
+
+// sockjsTransport adapts a SockJS session (XHR-streaming, XHR-polling,
+// EventSource, or websocket sub-transport, all indistinguishable past this
+// point) to Transport, so corporate proxies that block the Upgrade header
+// still get push delivery.
+type sockjsTransport struct {
+	session   sockjs.Session
+	heartbeat time.Duration
+}
+
+// NewSockJSTransport wraps a SockJS session accepted by the /sockjs
+// handler. heartbeat is the interval at which SockJS itself will emit
+// keep-alive frames, taken from the "heartbeat_interval_ms" config knob.
+func NewSockJSTransport(session sockjs.Session, heartbeat time.Duration) Transport {
+	return &sockjsTransport{session: session, heartbeat: heartbeat}
+}
+
+func (t *sockjsTransport) Send(v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.session.Send(string(raw))
+}
+
+func (t *sockjsTransport) Receive(raw *[]byte) error {
+	msg, err := t.session.Recv()
+	if err != nil {
+		return err
+	}
+	*raw = []byte(msg)
+	return nil
+}
+
+func (t *sockjsTransport) Close() error {
+	return t.session.Close(0, "")
+}
+
+func (t *sockjsTransport) Heartbeat() (time.Duration, bool) {
+	return t.heartbeat, true
+}
+
+// TransportConfig holds the config knobs for the SockJS side: which
+// sub-transports are allowed, and how often SockJS should emit heartbeat
+// frames to keep middleboxes from closing idle connections. Only the
+// "websocket" entry of AllowedTransports has an effect (SockJSHandler);
+// the XHR-streaming, XHR-polling and EventSource fallbacks are served
+// whether or not they are listed.
+type TransportConfig struct {
+	AllowedTransports []string
+	HeartbeatInterval time.Duration
+}
+
+// NewTransportConfig reads "allowed_transports" (a []string of SockJS
+// sub-transport names; defaults to all of them) and
+// "heartbeat_interval_ms" (defaults to 25000, matching SockJS's own
+// default) from the app config.
+func NewTransportConfig(config util.JsMap) *TransportConfig {
+	tc := &TransportConfig{
+		AllowedTransports: []string{"xhr-streaming", "xhr-polling", "eventsource", "websocket"},
+		HeartbeatInterval: 25 * time.Second,
+	}
+	if raw, ok := config["allowed_transports"].([]string); ok && len(raw) > 0 {
+		tc.AllowedTransports = raw
+	}
+	if ms, ok := config["heartbeat_interval_ms"].(int64); ok && ms > 0 {
+		tc.HeartbeatInterval = time.Duration(ms) * time.Millisecond
+	}
+	return tc
+}
+
+// Allows reports whether the named sub-transport is in AllowedTransports.
+func (tc *TransportConfig) Allows(name string) bool {
+	for _, t := range tc.AllowedTransports {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
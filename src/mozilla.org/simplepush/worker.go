@@ -5,7 +5,7 @@
 package simplepush
 
 import (
-	"code.google.com/p/go.net/websocket"
+	"mozilla.org/simplepush/broker"
 	"mozilla.org/simplepush/sperrors"
 	"mozilla.org/util"
 
@@ -23,9 +23,12 @@ var MissingChannelErr = errors.New("Missing channelID")
 //      these write back to the websocket.
 
 type Worker struct {
-	log    *util.HekaLogger
-	state  int
-	filter *regexp.Regexp
+	log      *util.HekaLogger
+	state    int
+	filter   *regexp.Regexp
+	tokens   *TokenKeyManager
+	locator  Locator
+	maxConns int64
 }
 
 const (
@@ -41,21 +44,37 @@ const (
 func NewWorker(config util.JsMap) *Worker {
 	// Allow [0-9a-z_-]/i as valid ChannelID characters.
 	filter := regexp.MustCompile("[^\\w-]")
-	return &Worker{log: util.NewHekaLogger(config),
-		state:  INACTIVE,
-		filter: filter}
+	logger := util.NewHekaLogger(config)
+	tokens, err := NewTokenKeyManager(config)
+	if err != nil {
+		// A bad token_key is a startup-time misconfiguration, not
+		// something we can recover from per-connection. Fall back to
+		// unencrypted endpoints rather than panic the worker pool.
+		logger.Error("worker", "Invalid token_key, disabling endpoint encryption",
+			util.JsMap{"error": err})
+		tokens = &TokenKeyManager{}
+	}
+	locator := activeLocator
+	if locator == nil {
+		locator = NewStaticLocator(config, logger)
+	}
+	return &Worker{log: logger,
+		state:    INACTIVE,
+		filter:   filter,
+		tokens:   tokens,
+		locator:  locator,
+		maxConns: maxConnections(config)}
 }
 
 func (self *Worker) sniffer(sock PushWS, in chan util.JsMap) {
-	// Sniff the websocket for incoming data.
-	// Reading from the websocket is a blocking operation, and we also
-	// need to write out when an even occurs. This isolates the incoming
-	// reads to a separate go process.
-	var socket = sock.Socket
+	// Sniff the transport for incoming data.
+	// Reading is a blocking operation, and we also need to write out
+	// when an event occurs. This isolates the incoming reads to a
+	// separate go process.
 	for {
 		var raw []byte
 		var buffer util.JsMap
-		err := websocket.Message.Receive(socket, &raw)
+		err := sock.Transport.Receive(&raw)
 		if err != nil {
 			self.log.Error("worker",
 				"Websocket Error",
@@ -85,20 +104,23 @@ func (self *Worker) sniffer(sock PushWS, in chan util.JsMap) {
 	}
 	// Clean up the server side (This will delete records associated
 	// with the UAID.
+	registry.Unregister(sock.Uaid)
+	decrConn()
 	sock.Scmd <- PushCommand{Command: DIE, Arguments: nil}
-	socket.Close()
+	sock.Transport.Close()
 }
 
 // standardize the error reporting back to the client.
 func (self *Worker) handleError(sock PushWS, message util.JsMap, err error) (ret error) {
 	self.log.Info("worker", "Sending error", util.JsMap{"error": err})
 	message["status"], message["error"] = sperrors.ErrToStatus(err)
-	return websocket.JSON.Send(sock.Socket, message)
+	return sock.Transport.Send(message)
 }
 
 // General workhorse loop for the websocket handler.
 func (self *Worker) Run(sock PushWS) {
 	var err error
+	incrConn()
 
 	// Instantiate a websocket reader, a blocking operation
 	// (Remember, we need to be able to write out PUSH events
@@ -126,8 +148,10 @@ func (self *Worker) Run(sock PushWS) {
 				if r := recover(); r != nil {
 					sock.Logger.Error("worker", r.(error).Error(), nil)
 				}
+				registry.Unregister(sock.Uaid)
+				decrConn()
 				sock.Scmd <- PushCommand{Command: DIE, Arguments: nil}
-				sock.Socket.Close()
+				sock.Transport.Close()
 				return
 			}(sock)
 			if len(buffer) > 0 {
@@ -172,8 +196,10 @@ func (self *Worker) Run(sock PushWS) {
 			}
 		}
 	}
+	registry.Unregister(sock.Uaid)
+	decrConn()
 	sock.Scmd <- PushCommand{Command: DIE, Arguments: nil}
-	sock.Socket.Close()
+	sock.Transport.Close()
 }
 
 // Associate the UAID for this socket connection (and flush any data that
@@ -198,6 +224,19 @@ func (self *Worker) Hello(sock *PushWS, buffer interface{}) (err error) {
 		// Must include "channelIDs" (even if empty)
 		return sperrors.MissingDataError
 	}
+	if overCapacity(self.maxConns) {
+		// Reject before allocating a UUID or touching storage; the
+		// client already holds a socket, so this is the only point
+		// left to push back before the connection's cost is sunk.
+		self.log.Info("worker", "Rejecting hello, too many connections",
+			util.JsMap{"current": CurrentConnections(), "max": self.maxConns})
+		sock.Transport.Send(util.JsMap{
+			"messageType": data["messageType"],
+			"status":      503,
+			"retryAfter":  retryAfter()})
+		sock.Transport.Close()
+		return nil
+	}
 	if len(sock.Uaid) > 0 && len(data["uaid"].(string)) > 0 && sock.Uaid != data["uaid"].(string) {
 		// if there's already a Uaid for this channel, don't accept a new one
 		return sperrors.InvalidCommandError
@@ -212,6 +251,21 @@ func (self *Worker) Hello(sock *PushWS, buffer interface{}) (err error) {
 			sock.Uaid, _ = GenUUID4()
 		}
 	}
+	// Before registering locally, check whether this UAID actually
+	// belongs to another node in the fleet. Locator shards UAIDs
+	// deterministically across contacts, so every node agrees on the
+	// answer without a shared session store.
+	if host, mine, lerr := self.locator.Owner(sock.Uaid); lerr == nil && !mine {
+		self.log.Info("worker", "Redirecting client to owning node",
+			util.JsMap{"uaid": sock.Uaid, "host": host})
+		sock.Transport.Send(util.JsMap{
+			"messageType": data["messageType"],
+			"uaid":        sock.Uaid,
+			"status":      302,
+			"redirect":    fmt.Sprintf("wss://%s/", host)})
+		sock.Transport.Close()
+		return nil
+	}
 	// register the sockets (NOOP)
 	// register any proprietary connection requirements
 	// alert the master of the new UAID.
@@ -225,11 +279,15 @@ func (self *Worker) Hello(sock *PushWS, buffer interface{}) (err error) {
 	if err = sock.Store.SetUAIDHost(sock.Uaid); err != nil {
 		return err
 	}
+	// Make this node reachable for cross-node fan-out: local sockets get
+	// flushed straight off the registry, everyone else's UpdateHandler
+	// calls find us through the Broker subscription.
+	registry.Register(activeBroker, sock.Uaid, *sock)
 
 	self.log.Debug("worker", "sending response",
 		util.JsMap{"cmd": "hello", "error": err,
 			"uaid": sock.Uaid})
-	websocket.JSON.Send(sock.Socket, util.JsMap{
+	sock.Transport.Send(util.JsMap{
 		"messageType": data["messageType"],
 		"status":      result.Command,
 		"uaid":        sock.Uaid})
@@ -271,7 +329,9 @@ func (self *Worker) Ack(sock PushWS, buffer interface{}) (err error) {
 	return err
 }
 
-// Register a new ChannelID. Optionally, encrypt the endpoint.
+// Register a new ChannelID. If token_key is configured, the endpoint's
+// {uaid}/{channelID} tuple is sealed into an opaque, rotate-friendly token
+// rather than exposed directly in the pushEndpoint path.
 func (self *Worker) Register(sock PushWS, buffer interface{}) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -310,6 +370,20 @@ func (self *Worker) Register(sock PushWS, buffer interface{}) (err error) {
 	result := <-sock.Scmd
 	self.log.Debug("worker", fmt.Sprintf("Server returned %s", result), nil)
 	endpoint := result.Arguments.(util.JsMap)["pushEndpoint"].(string)
+	if self.tokens.Enabled() {
+		// Swap the raw {uaid}/{channelID} tuple the server baked into
+		// the endpoint path for an opaque, rotate-friendly token so
+		// device/channel identifiers never reach the client.
+		rawTuple := sock.Uaid + "/" + appid
+		token, terr := self.tokens.Encrypt(sock.Uaid, appid)
+		if terr != nil {
+			self.log.Error("worker",
+				fmt.Sprintf("ERROR: could not encrypt endpoint %s", terr),
+				nil)
+			return terr
+		}
+		endpoint = strings.Replace(endpoint, rawTuple, token, 1)
+	}
 	// return the info back to the socket
 	reply := util.JsMap{"messageType": data["messageType"],
 		"uaid":         sock.Uaid,
@@ -317,7 +391,7 @@ func (self *Worker) Register(sock PushWS, buffer interface{}) (err error) {
 		"channelID":    data["channelID"],
 		"pushEndpoint": endpoint}
 	self.log.Debug("worker", "sending response", reply)
-	websocket.JSON.Send(sock.Socket, reply)
+	sock.Transport.Send(reply)
 	return err
 }
 
@@ -345,7 +419,7 @@ func (self *Worker) Unregister(sock PushWS, buffer interface{}) (err error) {
 	sock.Store.DeleteAppID(sock.Uaid, appid, false)
 	self.log.Debug("worker", "sending response",
 		util.JsMap{"cmd": "unregister", "error": err})
-	websocket.JSON.Send(sock.Socket, util.JsMap{
+	sock.Transport.Send(util.JsMap{
 		"messageType": data["messageType"],
 		"status":      200,
 		"channelID":   appid})
@@ -368,7 +442,7 @@ func (self *Worker) Flush(sock PushWS, lastAccessed int64) {
 		// Have the server clean up records associated with this UAID.
 		// (Probably "none", but still good for housekeeping)
 		sock.Scmd <- PushCommand{Command: DIE, Arguments: nil}
-		sock.Socket.Close()
+		sock.Transport.Close()
 	}
 	// Fetch the pending updates from #storage
 	updates, err := sock.Store.GetUpdates(sock.Uaid, lastAccessed)
@@ -381,12 +455,22 @@ func (self *Worker) Flush(sock PushWS, lastAccessed int64) {
 	}
 	updates["messageType"] = messageType
 	self.log.Debug("worker", "Flushing data back to socket", updates)
-	websocket.JSON.Send(sock.Socket, updates)
+	sock.Transport.Send(updates)
 }
 
 func (self *Worker) Ping(sock PushWS, buffer interface{}) (err error) {
 	data := buffer.(util.JsMap)
-	websocket.JSON.Send(sock.Socket, util.JsMap{
+	// A ping is the client proving it's still alive even if it never
+	// re-Hellos; keep its registry entry (and Broker subscription) from
+	// being reaped out from under it.
+	registry.Touch(sock.Uaid)
+	if _, managed := sock.Transport.Heartbeat(); managed {
+		// SockJS (and any other transport with its own keep-alive
+		// frames) already tells the client the connection is alive;
+		// sending a protocol-level pong on top would just be noise.
+		return nil
+	}
+	sock.Transport.Send(util.JsMap{
 		"messageType": data["messageType"],
 		"status":      200})
 	return nil